@@ -3,6 +3,8 @@ package chunkserver
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io"
@@ -17,15 +19,20 @@ import (
 	"github.com/jiajunhuang/hfs/pkg/files"
 	"github.com/jiajunhuang/hfs/pkg/logger"
 	"github.com/jiajunhuang/hfs/pkg/utils"
+	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 )
 
 var (
-	ErrFailedWrite     = errors.New("failed to write file or chunk")
-	ErrFailedWriteMeta = errors.New("failed to sync metadata of file or chunk")
-	ErrFailedGetFile   = errors.New("failed to get file or chunk")
-	ErrFileNotExist    = errors.New("file or chunk not exist")
-	ErrAlreadyExist    = errors.New("file or chunk already exist")
+	ErrFailedWrite      = errors.New("failed to write file or chunk")
+	ErrFailedWriteMeta  = errors.New("failed to sync metadata of file or chunk")
+	ErrFailedGetFile    = errors.New("failed to get file or chunk")
+	ErrFileNotExist     = errors.New("file or chunk not exist")
+	ErrAlreadyExist     = errors.New("file or chunk already exist")
+	ErrNotEnoughPeers   = errors.New("not enough peer chunkservers to satisfy replica number")
+	ErrWriteQuorumFail  = errors.New("write quorum was not acknowledged by enough replicas")
+	ErrNoReplicaReadOK  = errors.New("failed to read chunk from local disk or any replica")
+	ErrChecksumMismatch = errors.New("uploaded data failed checksum verification")
 )
 
 type ChunkServer struct {
@@ -34,12 +41,114 @@ type ChunkServer struct {
 	etcdClient *clientv3.Client
 }
 
+// peer describes another chunkserver discovered under config.WorkerBasePath.
+type peer struct {
+	name string
+	addr string
+}
+
+// peers returns every other chunkserver currently holding a live lease in
+// etcd, excluding ourselves.
+func (s *ChunkServer) peers() ([]peer, error) {
+	kvClient := clientv3.NewKV(s.etcdClient)
+	resp, err := kvClient.Get(context.Background(), config.WorkerBasePath, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	var out []peer
+	for _, kv := range resp.Kvs {
+		name := string(kv.Key)[len(config.WorkerBasePath):]
+		if name == s.name {
+			continue
+		}
+		out = append(out, peer{name: name, addr: string(kv.Value)})
+	}
+	return out, nil
+}
+
+// pickReplicaTargets picks up to n peers to host copies of a chunk.
+func pickReplicaTargets(candidates []peer, n int) []peer {
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	return candidates[:n]
+}
+
+// replicateChunk sends the given chunk bytes to the given peer over
+// ReplicateChunk, which on the peer side behaves like CreateChunk but
+// creates the chunk file if it doesn't exist yet.
+func (s *ChunkServer) replicateChunk(p peer, c pb.Chunk, data []byte) error {
+	conn, err := grpc.Dial(p.addr, grpc.WithInsecure())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	client := pb.NewChunkServerClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err = client.ReplicateChunk(ctx, &pb.ReplicateChunkRequest{ChunkUUID: c.UUID, Data: data})
+	return err
+}
+
+// replicate fans the chunk out to config.ReplicaNum-1 peers, waits for every
+// one of them to answer, and fails unless config.WriteQuorum of them
+// (including ourselves) acknowledged the write. c.Replicas is updated in
+// place with the peers that actually hold a copy.
+func (s *ChunkServer) replicate(c *pb.Chunk, data []byte) error {
+	wanted := config.ReplicaNum - 1
+	if wanted <= 0 {
+		return nil
+	}
+
+	candidates, err := s.peers()
+	if err != nil {
+		logger.WithChunk(c.UUID, c.Used).WithError(err).Error("failed to discover peers")
+		return err
+	}
+
+	targets := pickReplicaTargets(candidates, wanted)
+	if len(targets)+1 < config.WriteQuorum {
+		return ErrNotEnoughPeers
+	}
+
+	type result struct {
+		p   peer
+		err error
+	}
+	results := make(chan result, len(targets))
+	for _, t := range targets {
+		go func(t peer) {
+			results <- result{p: t, err: s.replicateChunk(t, *c, data)}
+		}(t)
+	}
+
+	acked := []string{s.name}
+	for range targets {
+		r := <-results
+		if r.err != nil {
+			logger.WithFields(logrus.Fields{"chunk": c.UUID, "peer": r.p.name}).WithError(r.err).Error("failed to replicate chunk to peer")
+			continue
+		}
+		acked = append(acked, r.p.name)
+	}
+
+	if len(acked) < config.WriteQuorum {
+		return ErrWriteQuorumFail
+	}
+
+	c.Replicas = acked
+	return nil
+}
+
 func (s *ChunkServer) CreateFile(stream pb.ChunkServer_CreateFileServer) error {
 	var file = pb.File{
 		UUID: uuid.New().String(),
 		// FileName
 		// Size
-		ReplicaNum: 1,
+		ReplicaNum: int32(config.ReplicaNum),
 		CreatedAt:  time.Now().Unix(),
 		UpdatedAt:  time.Now().Unix(),
 		// Chunks
@@ -52,40 +161,40 @@ func (s *ChunkServer) CreateFile(stream pb.ChunkServer_CreateFileServer) error {
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			logger.Sugar.Errorf("failed to receive chunk: %s", err)
+			logger.WithFields(logrus.Fields{"file": file.UUID}).WithError(err).Error("failed to receive chunk")
 			return ErrFailedWrite
 		}
 		file.FileName = fileChunkData.Msg
 		dataSize := int64(len(fileChunkData.Data))
 		size += dataSize
 
+		zeros := make([]byte, config.ChunkSize-len(fileChunkData.Data))
+		data := append(fileChunkData.Data, zeros...)
+		sum := sha256.Sum256(fileChunkData.Data)
+		hash := hex.EncodeToString(sum[:])
+
 		c := pb.Chunk{
-			UUID:     uuid.New().String(),
+			UUID:     hash,
+			Hash:     hash,
 			Size:     int64(config.ChunkSize), // for now
 			Used:     dataSize,
 			Replicas: []string{s.name},
 			FileUUID: file.UUID,
 		}
 
-		chunkPath := config.ChunkBasePath + c.UUID
-		zeros := make([]byte, config.ChunkSize-len(fileChunkData.Data))
-		data := append(fileChunkData.Data, zeros...)
-		if err := files.Append(chunkPath, bytes.NewReader(data)); err != nil {
-			logger.Sugar.Errorf("failed to write data into chunk %s: %s", c.UUID, err)
+		if config.EncodingScheme == config.EncodingSchemeRS {
+			infos, err := s.encodeAndDistribute(c.UUID, c.FileUUID, data)
+			if err != nil {
+				logger.WithChunk(c.UUID, c.Used).WithError(err).Error("failed to erasure-code chunk")
+				return ErrFailedWrite
+			}
+			c.Replicas = nil
+			c.Shards = infos
+		} else if err := s.writeOrDedupeChunk(&c, data); err != nil {
+			logger.WithChunk(c.UUID, c.Used).WithError(err).Error("failed to write or dedupe chunk")
 			return ErrFailedWrite
 		}
 
-		// sync metadata
-		v, err := utils.ToJSONString(c)
-		if err != nil {
-			logger.Sugar.Errorf("failed to sync metadata of chunk %s", c.UUID)
-			return ErrFailedWriteMeta
-		}
-		_, err = kvClient.Put(context.Background(), chunkPath, v)
-		if err != nil {
-			logger.Sugar.Errorf("failed to sync metadata of chunk %s", c.UUID)
-			return ErrFailedWriteMeta
-		}
 		file.Chunks = append(file.Chunks, &c)
 	}
 
@@ -93,17 +202,17 @@ func (s *ChunkServer) CreateFile(stream pb.ChunkServer_CreateFileServer) error {
 	file.Size = size
 	v, err := utils.ToJSONString(file)
 	if err != nil {
-		logger.Sugar.Errorf("failed to sync metadata of file %s", file.UUID)
+		logger.WithFile(file.UUID, file.FileName).WithError(err).Error("failed to sync metadata of file")
 		return ErrFailedWriteMeta
 	}
 	filePath := config.FileBasePath + file.UUID
 	_, err = kvClient.Put(context.Background(), filePath, v)
 	if err != nil {
-		logger.Sugar.Errorf("failed to sync metadata of chunk %s", file.UUID)
+		logger.WithFile(file.UUID, file.FileName).WithError(err).Error("failed to sync metadata of file")
 		return ErrFailedWriteMeta
 	}
 
-	logger.Sugar.Infof("file %s created", file.UUID)
+	logger.WithFile(file.UUID, file.FileName).Info("file created")
 	return stream.SendAndClose(&pb.CreateFileResponse{Code: 0, File: &file})
 }
 
@@ -113,14 +222,14 @@ func (s *ChunkServer) RemoveFile(ctx context.Context, file *pb.File) (*pb.Generi
 
 	resp, err := kvClient.Get(context.Background(), filePath)
 	if err != nil {
-		logger.Sugar.Errorf("failed to get metadata of file %s", filePath)
+		logger.WithFields(logrus.Fields{"file": filePath}).WithError(err).Error("failed to get metadata of file")
 		return nil, ErrFailedGetFile
 	}
 
 	if resp.Count == 0 {
 		return nil, ErrFileNotExist
 	} else if resp.Count != 1 {
-		logger.Sugar.Errorf("bad metadata of file %s: %+v", filePath, resp)
+		logger.WithFields(logrus.Fields{"file": filePath, "kvs": resp.Kvs}).Error("bad metadata of file")
 		return nil, ErrFailedGetFile
 	}
 
@@ -130,20 +239,22 @@ func (s *ChunkServer) RemoveFile(ctx context.Context, file *pb.File) (*pb.Generi
 	chunks := file.Chunks
 
 	for _, c := range chunks {
-		chunkPath := config.ChunkBasePath + c.UUID
-		if err := files.Remove(chunkPath); err != nil {
-			logger.Sugar.Errorf("failed to remove chunk %s: %s", c.UUID, err)
+		if len(c.Shards) > 0 {
+			if err := s.releaseShards(c); err != nil {
+				logger.WithChunk(c.UUID, c.Used).WithError(err).Error("failed to release erasure-coded shards")
+			}
+			continue
 		}
-		if _, err := kvClient.Delete(context.Background(), chunkPath); err != nil {
-			logger.Sugar.Errorf("failed to delete metadata of chunk %s: %s", c.UUID, err)
+		if err := s.releaseChunk(c.UUID); err != nil {
+			logger.WithChunk(c.UUID, c.Used).WithError(err).Error("failed to release chunk")
 		}
 	}
 
 	if _, err := kvClient.Delete(context.Background(), config.FileBasePath+file.UUID); err != nil {
-		logger.Sugar.Errorf("failed to delete metadata of file %s: %s", file.UUID, err)
+		logger.WithFile(file.UUID, file.FileName).WithError(err).Error("failed to delete metadata of file")
 	}
 
-	logger.Sugar.Infof("file %s removed", file.UUID)
+	logger.WithFile(file.UUID, file.FileName).Info("file removed")
 	return &pb.GenericResponse{Code: 0, Msg: "success"}, nil
 }
 
@@ -156,28 +267,74 @@ func (s *ChunkServer) CreateChunk(ctx context.Context, file *pb.FileChunkData) (
 	}
 
 	if err := files.Append(chunkPath, bytes.NewReader(file.Data)); err != nil {
-		logger.Sugar.Errorf("failed to create chunk %s: %s", chunkUUID, err)
+		logger.WithFields(logrus.Fields{"chunk": chunkUUID}).WithError(err).Error("failed to create chunk")
 		return nil, ErrFailedWrite
 	}
-	logger.Sugar.Infof("chunk %s has been create", chunkUUID)
+	logger.WithFields(logrus.Fields{"chunk": chunkUUID}).Info("chunk created")
 
 	return &pb.GenericResponse{Code: 0, Msg: chunkUUID}, nil
 }
 
+// ReplicateChunk accepts a chunk's bytes pushed by another chunkserver and
+// appends them locally, creating the chunk file if this is the
+// first time we've seen it. It's the peer-side counterpart of replicate().
+func (s *ChunkServer) ReplicateChunk(ctx context.Context, req *pb.ReplicateChunkRequest) (*pb.GenericResponse, error) {
+	chunkPath := config.ChunkBasePath + req.ChunkUUID
+
+	if err := files.Append(chunkPath, bytes.NewReader(req.Data)); err != nil {
+		logger.WithFields(logrus.Fields{"chunk": req.ChunkUUID}).WithError(err).Error("failed to replicate chunk")
+		return nil, ErrFailedWrite
+	}
+	logger.WithFields(logrus.Fields{"chunk": req.ChunkUUID}).Info("chunk replicated from peer")
+
+	return &pb.GenericResponse{Code: 0, Msg: req.ChunkUUID}, nil
+}
+
+// fetchChunkFromPeer pulls a chunk's bytes from a peer that's known to hold
+// a replica, for use when the local copy is missing or corrupt.
+func (s *ChunkServer) fetchChunkFromPeer(addr, chunkUUID string) ([]byte, error) {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := pb.NewChunkServerClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := client.FetchChunk(ctx, &pb.FetchChunkRequest{ChunkUUID: chunkUUID})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// FetchChunk serves a local chunk's raw bytes to a peer, either for
+// replica-fallback reads or for reconciliation.
+func (s *ChunkServer) FetchChunk(ctx context.Context, req *pb.FetchChunkRequest) (*pb.FetchChunkResponse, error) {
+	chunkPath := config.ChunkBasePath + req.ChunkUUID
+	data, err := os.ReadFile(chunkPath)
+	if err != nil {
+		return nil, ErrFileNotExist
+	}
+	return &pb.FetchChunkResponse{Data: data}, nil
+}
+
 func (s *ChunkServer) ReadFile(req *pb.ReadFileRequest, stream pb.ChunkServer_ReadFileServer) error {
 	kvClient := clientv3.NewKV(s.etcdClient)
 	filePath := config.FileBasePath + req.FileUUID
 
 	resp, err := kvClient.Get(context.Background(), filePath)
 	if err != nil {
-		logger.Sugar.Errorf("failed to get metadata of file %s", filePath)
+		logger.WithFields(logrus.Fields{"file": filePath}).WithError(err).Error("failed to get metadata of file")
 		return ErrFailedGetFile
 	}
 
 	if resp.Count == 0 {
 		return ErrFileNotExist
 	} else if resp.Count != 1 {
-		logger.Sugar.Errorf("bad metadata of file %s: %+v", filePath, resp)
+		logger.WithFields(logrus.Fields{"file": filePath, "kvs": resp.Kvs}).Error("bad metadata of file")
 		return ErrFailedGetFile
 	}
 
@@ -187,28 +344,105 @@ func (s *ChunkServer) ReadFile(req *pb.ReadFileRequest, stream pb.ChunkServer_Re
 	}
 	chunks := file.Chunks
 
+	length := req.Length
+	if length <= 0 {
+		length = file.Size - req.Offset
+	}
+	remaining := length
+
+	var consumed int64
 	for i, c := range chunks {
-		// read chunk from local file system. TODO: read it from one of it's replica
-		chunkPath := config.ChunkBasePath + c.UUID
-		f, err := os.Open(chunkPath)
+		chunkStart := consumed
+		consumed += c.Used
+
+		if consumed <= req.Offset || remaining <= 0 {
+			continue
+		}
+
+		skip := int64(0)
+		if req.Offset > chunkStart {
+			skip = req.Offset - chunkStart
+		}
+		want := c.Used - skip
+		if want > remaining {
+			want = remaining
+		}
+
+		buf, err := s.readChunkRange(c, skip, want)
 		if err != nil {
-			logger.Sugar.Errorf("failed to read %dth chunk %s: %s", i, c.UUID, err)
+			logger.WithFields(logrus.Fields{"file": req.FileUUID, "chunk": c.UUID, "index": i}).WithError(err).Error("failed to read chunk")
 			return err
 		}
 
-		buf := make([]byte, config.ChunkSize)
-		for {
-			_, err := f.Read(buf)
-			if err == io.EOF {
-				break
+		stream.Send(&pb.FileChunkData{Data: buf, Msg: file.FileName})
+		remaining -= want
+	}
+
+	logger.WithFields(logrus.Fields{"file": req.FileUUID, "offset": req.Offset, "length": length}).Info("file read")
+	return nil
+}
+
+// readChunk reads a chunk's whole used bytes from local disk, falling back
+// to one of its replicas if the local file is missing or corrupt, or
+// reconstructing it from its erasure-coded shards if it was stored with RS
+// encoding.
+func (s *ChunkServer) readChunk(c *pb.Chunk) ([]byte, error) {
+	return s.readChunkRange(c, 0, c.Used)
+}
+
+// readChunkRange reads `want` bytes starting `skip` bytes into a chunk's
+// used region. The common case - a healthy local chunk - seeks straight to
+// the requested offset instead of reading bytes the caller doesn't want;
+// replica fallback and erasure-coded chunks fetch the whole chunk and slice
+// it, since both already have to reassemble the full chunk anyway.
+func (s *ChunkServer) readChunkRange(c *pb.Chunk, skip, want int64) ([]byte, error) {
+	if len(c.Shards) > 0 {
+		data, err := s.reconstructChunk(c.Shards, c.Used)
+		if err != nil {
+			return nil, err
+		}
+		return data[skip : skip+want], nil
+	}
+
+	chunkPath := config.ChunkBasePath + c.UUID
+	f, err := os.Open(chunkPath)
+	if err == nil {
+		defer f.Close()
+		if _, err := f.Seek(skip, io.SeekStart); err == nil {
+			buf := make([]byte, want)
+			if _, err := io.ReadFull(f, buf); err == nil {
+				return buf, nil
 			}
-			// write it to stream
-			stream.Send(&pb.FileChunkData{Data: buf[:c.Used], Msg: file.FileName})
 		}
 	}
+	logger.WithChunk(c.UUID, c.Used).Error("local copy is missing or corrupt, falling back to replicas")
 
-	logger.Sugar.Infof("file %s readed", req.FileUUID)
-	return nil
+	peers, perr := s.peers()
+	if perr != nil {
+		return nil, perr
+	}
+	addrByName := map[string]string{}
+	for _, p := range peers {
+		addrByName[p.name] = p.addr
+	}
+
+	for _, name := range c.Replicas {
+		if name == s.name {
+			continue
+		}
+		addr, ok := addrByName[name]
+		if !ok {
+			continue
+		}
+		data, ferr := s.fetchChunkFromPeer(addr, c.UUID)
+		if ferr != nil {
+			logger.WithFields(logrus.Fields{"chunk": c.UUID, "peer": name}).WithError(ferr).Error("failed to fetch chunk from replica")
+			continue
+		}
+		return data[skip : skip+want], nil
+	}
+
+	return nil, ErrNoReplicaReadOK
 }
 
 func (s *ChunkServer) KeepAlive() {
@@ -218,27 +452,121 @@ func (s *ChunkServer) KeepAlive() {
 		lease := clientv3.NewLease(s.etcdClient)
 		grantResp, err := lease.Grant(context.TODO(), 10)
 		if err != nil {
-			logger.Sugar.Errorf("failed to grant lease: %s", err)
+			logger.WithFields(logrus.Fields{"worker": s.name}).WithError(err).Error("failed to grant lease")
 			continue
 		}
 		_, err = kvClient.Put(context.Background(), config.WorkerBasePath+s.name, s.ip, clientv3.WithLease(grantResp.ID))
 		if err != nil {
-			logger.Sugar.Errorf("failed to put %s to %s: %s", s.name, s.ip, err)
+			logger.WithFields(logrus.Fields{"worker": s.name, "ip": s.ip}).WithError(err).Error("failed to refresh worker lease")
 		} else {
-			logger.Sugar.Infof("refresh ip %s to worker %s in KV %+v", s.name, s.ip, kvClient)
+			logger.WithFields(logrus.Fields{"worker": s.name, "ip": s.ip}).Info("refreshed worker lease")
 		}
 		time.Sleep(time.Second * 7)
 	}
 }
 
+// ChunkWatcher watches both chunk metadata and worker leases: it logs chunk
+// mutations, and when a worker's lease expires it re-replicates every chunk
+// that worker was hosting so replica counts stay healthy.
 func (s *ChunkServer) ChunkWatcher() {
 	chunkChan := s.etcdClient.Watch(context.Background(), config.ChunkBasePath, clientv3.WithPrefix())
+	workerChan := s.etcdClient.Watch(context.Background(), config.WorkerBasePath, clientv3.WithPrefix())
+
+	for {
+		select {
+		case resp := <-chunkChan:
+			for _, ev := range resp.Events {
+				logger.WithFields(logrus.Fields{"event": ev.Type, "key": string(ev.Kv.Key), "value": string(ev.Kv.Value)}).Info("watcher: chunk metadata changed")
+			}
+		case resp := <-workerChan:
+			for _, ev := range resp.Events {
+				if ev.Type != clientv3.EventTypeDelete {
+					continue
+				}
+				deadWorker := string(ev.Kv.Key)[len(config.WorkerBasePath):]
+				logger.WithFields(logrus.Fields{"worker": deadWorker}).Info("watcher: worker lease expired, re-replicating its chunks")
+				s.reReplicateChunksOf(deadWorker)
+				s.repairShardsOf(deadWorker)
+			}
+		}
+	}
+}
+
+// reReplicateChunksOf scans every known chunk and, for those that listed
+// deadWorker as a replica, pushes a fresh copy to a new peer and updates the
+// chunk's metadata in etcd.
+func (s *ChunkServer) reReplicateChunksOf(deadWorker string) {
+	kvClient := clientv3.NewKV(s.etcdClient)
+	resp, err := kvClient.Get(context.Background(), config.ChunkBasePath, clientv3.WithPrefix())
+	if err != nil {
+		logger.WithFields(logrus.Fields{"worker": deadWorker}).WithError(err).Error("failed to list chunks while reconciling worker")
+		return
+	}
+
+	for _, kv := range resp.Kvs {
+		var c pb.Chunk
+		if err := json.Unmarshal(kv.Value, &c); err != nil {
+			continue
+		}
+		if !containsString(c.Replicas, deadWorker) {
+			continue
+		}
+
+		data, err := s.readChunk(&c)
+		if err != nil {
+			logger.WithChunk(c.UUID, c.Used).WithError(err).Error("failed to read chunk for re-replication")
+			continue
+		}
+
+		candidates, err := s.peers()
+		if err != nil {
+			continue
+		}
+		var target *peer
+		for _, p := range candidates {
+			if p.name != deadWorker && !containsString(c.Replicas, p.name) {
+				target = &p
+				break
+			}
+		}
+		if target == nil {
+			logger.WithChunk(c.UUID, c.Used).Error("no spare peer available to re-replicate chunk")
+			continue
+		}
+
+		if err := s.replicateChunk(*target, c, data); err != nil {
+			logger.WithFields(logrus.Fields{"chunk": c.UUID, "peer": target.name}).WithError(err).Error("failed to re-replicate chunk")
+			continue
+		}
+
+		c.Replicas = append(removeString(c.Replicas, deadWorker), target.name)
+		v, err := utils.ToJSONString(c)
+		if err != nil {
+			continue
+		}
+		if _, err := kvClient.Put(context.Background(), string(kv.Key), v); err != nil {
+			logger.WithChunk(c.UUID, c.Used).WithError(err).Error("failed to update metadata of chunk after re-replication")
+		}
+	}
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
 
-	for resp := range chunkChan {
-		for _, ev := range resp.Events {
-			logger.Sugar.Infof("watcher: %s %q : %q\n", ev.Type, ev.Kv.Key, ev.Kv.Value)
+func removeString(haystack []string, needle string) []string {
+	out := make([]string, 0, len(haystack))
+	for _, s := range haystack {
+		if s != needle {
+			out = append(out, s)
 		}
 	}
+	return out
 }
 
 // StartChunkServer works as it's name
@@ -251,7 +579,7 @@ func StartChunkServer() {
 	)
 
 	if err != nil {
-		logger.Sugar.Fatalf("failed to connect to etcd: %s", err)
+		logger.WithFields(logrus.Fields{"endpoints": config.EtcdEndpoints}).WithError(err).Fatal("failed to connect to etcd")
 	}
 
 	defer etcdClient.Close()
@@ -262,11 +590,11 @@ func StartChunkServer() {
 	// grpc server
 	lis, err := net.Listen("tcp", config.GRPCAddr)
 	if err != nil {
-		logger.Sugar.Fatalf("failed to listen: %s", err)
+		logger.WithFields(logrus.Fields{"addr": config.GRPCAddr}).WithError(err).Fatal("failed to listen")
 	}
 
 	grpcServer := grpc.NewServer(grpc.MaxRecvMsgSize(config.GRPCMaxMsgSize), grpc.MaxSendMsgSize(config.GRPCMaxMsgSize))
 	pb.RegisterChunkServerServer(grpcServer, &chunkServer)
-	logger.Sugar.Infof("listen at %s", config.GRPCAddr)
+	logger.WithFields(logrus.Fields{"addr": config.GRPCAddr}).Info("listening")
 	grpcServer.Serve(lis)
 }
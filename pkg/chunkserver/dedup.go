@@ -0,0 +1,229 @@
+package chunkserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/jiajunhuang/hfs/pb"
+	"github.com/jiajunhuang/hfs/pkg/config"
+	"github.com/jiajunhuang/hfs/pkg/files"
+	"github.com/jiajunhuang/hfs/pkg/logger"
+	"github.com/jiajunhuang/hfs/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// writeOrDedupeChunk content-addresses a chunk by its hash: if a chunk with
+// the same hash already exists, it just bumps the stored refcount and skips
+// the write entirely; otherwise it claims the hash first with a CAS Put and
+// only then writes and replicates the bytes, so the claim itself - not the
+// write - is what's race-free between concurrent uploaders of identical
+// content. Nobody else can also "win" the same hash while the claim stands,
+// so the write path behind it runs once per claim. If the write,
+// replication or finalize step fails, the claim is dropped via abandonClaim,
+// so the next retry claims the hash afresh and writes the data instead of
+// deduping against metadata that was never backed by bytes.
+func (s *ChunkServer) writeOrDedupeChunk(c *pb.Chunk, data []byte) error {
+	kvClient := clientv3.NewKV(s.etcdClient)
+	chunkPath := config.ChunkBasePath + c.Hash
+
+	for {
+		claimed := *c
+		claimed.RefCount = 1
+		v, err := utils.ToJSONString(claimed)
+		if err != nil {
+			return err
+		}
+
+		txnResp, err := kvClient.Txn(context.Background()).
+			If(clientv3.Compare(clientv3.CreateRevision(chunkPath), "=", 0)).
+			Then(clientv3.OpPut(chunkPath, v)).
+			Else(clientv3.OpGet(chunkPath)).
+			Commit()
+		if err != nil {
+			return err
+		}
+
+		if txnResp.Succeeded {
+			// we own this hash now; nobody else can have claimed it, so it's
+			// safe to write and replicate the bytes exactly once. If either
+			// step fails, give up the claim so the next retry - ours or
+			// another writer's - can actually write the data instead of
+			// dedupeing against a chunk that was never backed by bytes.
+			if err := files.Append(chunkPath, bytes.NewReader(data)); err != nil {
+				s.abandonClaim(chunkPath)
+				return err
+			}
+			if err := s.replicate(c, data); err != nil {
+				s.abandonClaim(chunkPath)
+				return err
+			}
+			// replicate just updated c.Replicas with the real acked peer
+			// list, which is newer than what the claim above persisted -
+			// write that back now, so the etcd record (and anyone doing
+			// replica-fallback reads or re-replication off it) reflects
+			// where the bytes actually live instead of the pre-replication
+			// placeholder.
+			if err := s.finalizeClaim(chunkPath, c); err != nil {
+				s.abandonClaim(chunkPath)
+				return err
+			}
+			logger.WithChunk(c.UUID, c.Used).Info("wrote new content-addressed chunk")
+			return nil
+		}
+
+		kvs := txnResp.Responses[0].GetResponseRange().Kvs
+		if len(kvs) == 0 {
+			continue // the claim we lost to was since removed, retry
+		}
+
+		var existing pb.Chunk
+		if err := json.Unmarshal(kvs[0].Value, &existing); err != nil {
+			return err
+		}
+		existing.RefCount++
+
+		ev, err := utils.ToJSONString(existing)
+		if err != nil {
+			return err
+		}
+		updateResp, err := kvClient.Txn(context.Background()).
+			If(clientv3.Compare(clientv3.ModRevision(chunkPath), "=", kvs[0].ModRevision)).
+			Then(clientv3.OpPut(chunkPath, ev)).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if updateResp.Succeeded {
+			logger.WithChunk(existing.UUID, existing.Used).Info("deduped chunk against existing content")
+			*c = existing
+			return nil
+		}
+		// lost the race against another writer or remover, retry
+	}
+}
+
+// finalizeClaim overwrites a just-claimed chunk's metadata with the final
+// state of *c (in particular the real c.Replicas that replicate produced),
+// while preserving whatever refcount a concurrent follower may already have
+// bumped against the placeholder the claim put in place. It CAS-retries
+// against that follower rather than a plain Put, so a finalize racing a
+// follower's increment can't silently drop one or the other.
+func (s *ChunkServer) finalizeClaim(chunkPath string, c *pb.Chunk) error {
+	kvClient := clientv3.NewKV(s.etcdClient)
+
+	for {
+		resp, err := kvClient.Get(context.Background(), chunkPath)
+		if err != nil {
+			return err
+		}
+		if resp.Count == 0 {
+			// the claim was abandoned or removed from under us; there's
+			// nothing to race against, so just put our final value back.
+			final := *c
+			final.RefCount = 1
+			v, err := utils.ToJSONString(final)
+			if err != nil {
+				return err
+			}
+			if _, err := kvClient.Put(context.Background(), chunkPath, v); err != nil {
+				return err
+			}
+			*c = final
+			return nil
+		}
+
+		var current pb.Chunk
+		if err := json.Unmarshal(resp.Kvs[0].Value, &current); err != nil {
+			return err
+		}
+
+		final := *c
+		final.RefCount = current.RefCount
+		v, err := utils.ToJSONString(final)
+		if err != nil {
+			return err
+		}
+
+		txnResp, err := kvClient.Txn(context.Background()).
+			If(clientv3.Compare(clientv3.ModRevision(chunkPath), "=", resp.Kvs[0].ModRevision)).
+			Then(clientv3.OpPut(chunkPath, v)).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if txnResp.Succeeded {
+			*c = final
+			return nil
+		}
+		// lost the race against a follower bumping refcount, retry
+	}
+}
+
+// abandonClaim drops a chunk-hash claim that was never backed by a
+// successful write, so later retries of the same content see Count==0
+// again instead of incrementing a refcount for data that doesn't exist.
+func (s *ChunkServer) abandonClaim(chunkPath string) {
+	kvClient := clientv3.NewKV(s.etcdClient)
+	if _, err := kvClient.Delete(context.Background(), chunkPath); err != nil {
+		logger.WithFields(logrus.Fields{"chunk": chunkPath}).WithError(err).Error("failed to abandon failed chunk claim")
+	}
+}
+
+// releaseChunk decrements a content-addressed chunk's refcount and only
+// unlinks its bytes and metadata once the count reaches zero, so a chunk
+// shared by several files survives the removal of any one of them.
+func (s *ChunkServer) releaseChunk(chunkUUID string) error {
+	kvClient := clientv3.NewKV(s.etcdClient)
+	chunkPath := config.ChunkBasePath + chunkUUID
+
+	for {
+		resp, err := kvClient.Get(context.Background(), chunkPath)
+		if err != nil {
+			return err
+		}
+		if resp.Count == 0 {
+			return nil
+		}
+
+		var c pb.Chunk
+		if err := json.Unmarshal(resp.Kvs[0].Value, &c); err != nil {
+			return err
+		}
+		c.RefCount--
+
+		if c.RefCount > 0 {
+			v, err := utils.ToJSONString(c)
+			if err != nil {
+				return err
+			}
+			txnResp, err := kvClient.Txn(context.Background()).
+				If(clientv3.Compare(clientv3.ModRevision(chunkPath), "=", resp.Kvs[0].ModRevision)).
+				Then(clientv3.OpPut(chunkPath, v)).
+				Commit()
+			if err != nil {
+				return err
+			}
+			if txnResp.Succeeded {
+				return nil
+			}
+			continue
+		}
+
+		txnResp, err := kvClient.Txn(context.Background()).
+			If(clientv3.Compare(clientv3.ModRevision(chunkPath), "=", resp.Kvs[0].ModRevision)).
+			Then(clientv3.OpDelete(chunkPath)).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if txnResp.Succeeded {
+			if err := files.Remove(chunkPath); err != nil {
+				logger.WithChunk(chunkUUID, c.Used).WithError(err).Error("failed to unlink dereferenced chunk")
+			}
+			return nil
+		}
+		// metadata changed under us (another ref added or removed), retry
+	}
+}
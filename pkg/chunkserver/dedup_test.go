@@ -0,0 +1,162 @@
+package chunkserver
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/coreos/etcd/integration"
+	"github.com/jiajunhuang/hfs/pb"
+	"github.com/jiajunhuang/hfs/pkg/config"
+	"google.golang.org/grpc"
+)
+
+// newTestChunkServer spins up a single-member embedded etcd cluster and
+// returns a ChunkServer backed by it, for tests that exercise the
+// etcd-transactional code paths without a real cluster.
+func newTestChunkServer(t *testing.T) (*ChunkServer, func()) {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "chunkserver-test-")
+	if err != nil {
+		t.Fatalf("failed to create temp chunk dir: %v", err)
+	}
+	config.ChunkBasePath = dir + "/"
+
+	clus := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	s := &ChunkServer{name: "self", ip: "127.0.0.1:0", etcdClient: clus.RandClient()}
+
+	cleanup := func() {
+		clus.Terminate(t)
+		os.RemoveAll(dir)
+	}
+	return s, cleanup
+}
+
+// TestWriteOrDedupeChunkConcurrentIdenticalWrites reproduces the race the
+// CAS claim is meant to close: many goroutines racing to write the exact
+// same content must result in exactly one copy of the bytes on disk and a
+// refcount equal to the number of writers, never duplicated data and never
+// a permanently-unclaimed hash.
+func TestWriteOrDedupeChunkConcurrentIdenticalWrites(t *testing.T) {
+	s, cleanup := newTestChunkServer(t)
+	defer cleanup()
+
+	data := []byte("identical content written by every racing uploader")
+	const writers = 8
+
+	var wg sync.WaitGroup
+	errs := make([]error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := pb.Chunk{UUID: "unused", Hash: "deadbeef", FileUUID: "file"}
+			errs[i] = s.writeOrDedupeChunk(&c, data)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("writer %d: writeOrDedupeChunk returned error: %v", i, err)
+		}
+	}
+
+	chunkPath := config.ChunkBasePath + "deadbeef"
+	contents, err := os.ReadFile(chunkPath)
+	if err != nil {
+		t.Fatalf("failed to read back chunk: %v", err)
+	}
+	if len(contents) != len(data) {
+		t.Fatalf("chunk bytes duplicated: on-disk size = %d, want %d", len(contents), len(data))
+	}
+
+	resp, err := s.etcdClient.Get(context.Background(), chunkPath)
+	if err != nil {
+		t.Fatalf("failed to get chunk metadata: %v", err)
+	}
+	if resp.Count != 1 {
+		t.Fatalf("expected exactly one chunk metadata key, got %d", resp.Count)
+	}
+
+	var stored pb.Chunk
+	if err := json.Unmarshal(resp.Kvs[0].Value, &stored); err != nil {
+		t.Fatalf("failed to unmarshal stored chunk: %v", err)
+	}
+	if stored.RefCount != writers {
+		t.Fatalf("refcount = %d, want %d (one per racing writer)", stored.RefCount, writers)
+	}
+}
+
+// startTestPeerChunkServer runs peerServer as a real gRPC server on a local
+// port, so a primary ChunkServer's replicate() has an actual peer to
+// replicate to.
+func startTestPeerChunkServer(t *testing.T, peerServer *ChunkServer) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen for peer chunkserver: %v", err)
+	}
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterChunkServerServer(grpcServer, peerServer)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	return lis.Addr().String()
+}
+
+// TestWriteOrDedupeChunkPersistsReplicasAfterReplicate is the regression
+// test for a bug where writeOrDedupeChunk persisted the CAS claim's
+// pre-replication placeholder (c.Replicas = []string{self}) as the final
+// etcd record, discarding the real acked-peer list that replicate() had
+// just written into c.Replicas. That silently broke dead-peer detection:
+// reReplicateChunksOf and the replica-fallback read path both trust
+// c.Replicas to know who actually holds a copy.
+func TestWriteOrDedupeChunkPersistsReplicasAfterReplicate(t *testing.T) {
+	primary, cleanup := newTestChunkServer(t)
+	defer cleanup()
+
+	peerServer := &ChunkServer{name: "peer", ip: "", etcdClient: primary.etcdClient}
+	peerAddr := startTestPeerChunkServer(t, peerServer)
+
+	origReplicaNum, origWriteQuorum := config.ReplicaNum, config.WriteQuorum
+	config.ReplicaNum, config.WriteQuorum = 2, 2
+	t.Cleanup(func() { config.ReplicaNum, config.WriteQuorum = origReplicaNum, origWriteQuorum })
+
+	if _, err := primary.etcdClient.Put(context.Background(), config.WorkerBasePath+"peer", peerAddr); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+
+	data := []byte("content that must be replicated to the peer before the claim is finalized")
+	c := pb.Chunk{UUID: "unused", Hash: "cafebabe", FileUUID: "file"}
+	if err := primary.writeOrDedupeChunk(&c, data); err != nil {
+		t.Fatalf("writeOrDedupeChunk failed: %v", err)
+	}
+
+	if len(c.Replicas) != 2 {
+		t.Fatalf("c.Replicas = %v, want both self and peer", c.Replicas)
+	}
+
+	chunkPath := config.ChunkBasePath + "cafebabe"
+	resp, err := primary.etcdClient.Get(context.Background(), chunkPath)
+	if err != nil {
+		t.Fatalf("failed to get chunk metadata: %v", err)
+	}
+	if resp.Count != 1 {
+		t.Fatalf("expected exactly one chunk metadata key, got %d", resp.Count)
+	}
+
+	var stored pb.Chunk
+	if err := json.Unmarshal(resp.Kvs[0].Value, &stored); err != nil {
+		t.Fatalf("failed to unmarshal stored chunk: %v", err)
+	}
+	if len(stored.Replicas) != 2 {
+		t.Fatalf("persisted chunk metadata has Replicas = %v, want both self and peer - the claim must be finalized with the post-replicate value, not the pre-replicate placeholder", stored.Replicas)
+	}
+}
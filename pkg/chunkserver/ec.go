@@ -0,0 +1,374 @@
+package chunkserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/google/uuid"
+	"github.com/jiajunhuang/hfs/pb"
+	"github.com/jiajunhuang/hfs/pkg/config"
+	"github.com/jiajunhuang/hfs/pkg/files"
+	"github.com/jiajunhuang/hfs/pkg/logger"
+	"github.com/jiajunhuang/hfs/pkg/utils"
+	"github.com/klauspost/reedsolomon"
+	"github.com/sirupsen/logrus"
+)
+
+// shard is the etcd-persisted metadata of a single erasure-coded shard,
+// stored under a "shard/" sub-prefix of config.ChunkBasePath so
+// ChunkWatcher's existing prefix watch picks it up for free.
+type shard struct {
+	UUID        string `json:"uuid"`
+	ParentChunk string `json:"parent_chunk"` // the owning pb.Chunk.UUID
+	FileUUID    string `json:"file_uuid"`    // the owning pb.File.UUID, so a repair can find and fix the embedded pb.Chunk.Shards too
+	Index       int    `json:"index"`        // 0..k-1 are data shards, k..k+m-1 are parity
+	Host        string `json:"host"`
+	Size        int    `json:"size"`
+}
+
+func shardPath(shardUUID string) string {
+	return config.ChunkBasePath + "shard/" + shardUUID
+}
+
+// encodeAndDistribute Reed-Solomon encodes data into config.RSDataShards
+// data shards plus config.RSParityShards parity shards, places each on a
+// distinct chunkserver discovered via etcd, and records per-shard metadata.
+// The returned layout is what callers attach to the owning pb.Chunk.
+func (s *ChunkServer) encodeAndDistribute(chunkUUID, fileUUID string, data []byte) ([]*pb.ShardInfo, error) {
+	k, m := config.RSDataShards, config.RSParityShards
+
+	enc, err := reedsolomon.New(k, m)
+	if err != nil {
+		return nil, err
+	}
+
+	shardData, err := enc.Split(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(shardData); err != nil {
+		return nil, err
+	}
+
+	hosts, err := s.placementCandidates(k + m)
+	if err != nil {
+		return nil, err
+	}
+
+	kvClient := clientv3.NewKV(s.etcdClient)
+	infos := make([]*pb.ShardInfo, 0, k+m)
+	for i, data := range shardData {
+		host := hosts[i]
+		sh := shard{UUID: uuid.New().String(), ParentChunk: chunkUUID, FileUUID: fileUUID, Index: i, Host: host.name, Size: len(data)}
+
+		if err := s.placeShard(host, sh.UUID, data); err != nil {
+			logger.WithFields(logrus.Fields{"chunk": chunkUUID, "shard_index": i, "peer": host.name}).WithError(err).Error("failed to place shard")
+			return nil, err
+		}
+
+		v, err := utils.ToJSONString(sh)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := kvClient.Put(context.Background(), shardPath(sh.UUID), v); err != nil {
+			return nil, err
+		}
+
+		infos = append(infos, &pb.ShardInfo{ShardUUID: sh.UUID, Index: int32(i), Host: host.name})
+	}
+
+	return infos, nil
+}
+
+// releaseShards drops every shard of an erasure-coded chunk: its etcd
+// metadata always, and its on-disk bytes wherever we're the host. It's the
+// EC counterpart of releaseChunk, which only ever looks at
+// config.ChunkBasePath+c.UUID and so never sees an EC chunk's bytes, which
+// live under config.ChunkBasePath+"shard/"+shardUUID instead.
+func (s *ChunkServer) releaseShards(c *pb.Chunk) error {
+	kvClient := clientv3.NewKV(s.etcdClient)
+	var firstErr error
+
+	for _, info := range c.Shards {
+		if info.Host == s.name {
+			if err := files.Remove(shardPath(info.ShardUUID)); err != nil {
+				logger.WithFields(logrus.Fields{"chunk": c.UUID, "shard": info.ShardUUID}).WithError(err).Error("failed to unlink shard")
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		if _, err := kvClient.Delete(context.Background(), shardPath(info.ShardUUID)); err != nil {
+			logger.WithFields(logrus.Fields{"chunk": c.UUID, "shard": info.ShardUUID}).WithError(err).Error("failed to delete metadata of shard")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// placementCandidates returns n distinct chunkservers (ourselves included)
+// to host a chunk's shards.
+func (s *ChunkServer) placementCandidates(n int) ([]peer, error) {
+	peers, err := s.peers()
+	if err != nil {
+		return nil, err
+	}
+	all := append([]peer{{name: s.name, addr: s.ip}}, peers...)
+	if len(all) < n {
+		return nil, fmt.Errorf("need %d chunkservers to place shards, only found %d", n, len(all))
+	}
+	return all[:n], nil
+}
+
+// pickRepairTarget picks a chunkserver to host a shard rebuilt for
+// parentChunk: one that isn't deadWorker and doesn't already hold another
+// shard of the same chunk, so a rebuild never lands back on the host that
+// just lost it or collapses two shards onto the same server.
+func (s *ChunkServer) pickRepairTarget(shards []shard, deadWorker string) (peer, error) {
+	peers, err := s.peers()
+	if err != nil {
+		return peer{}, err
+	}
+	all := append([]peer{{name: s.name, addr: s.ip}}, peers...)
+
+	occupied := map[string]bool{deadWorker: true}
+	for _, sh := range shards {
+		if sh.Host != deadWorker {
+			occupied[sh.Host] = true
+		}
+	}
+
+	for _, p := range all {
+		if !occupied[p.name] {
+			return p, nil
+		}
+	}
+	return peer{}, fmt.Errorf("no chunkserver available to rebuild shard: all %d known hosts already hold a shard of this chunk", len(all))
+}
+
+// placeShard writes a shard's bytes to the given host, locally if it's us,
+// otherwise by pushing it through the same ReplicateChunk RPC used for
+// plain replicas.
+func (s *ChunkServer) placeShard(host peer, shardUUID string, data []byte) error {
+	if host.name == s.name {
+		return files.Append(shardPath(shardUUID), bytes.NewReader(data))
+	}
+	return s.replicateChunk(host, pb.Chunk{UUID: "shard/" + shardUUID}, data)
+}
+
+// fetchShard reads a shard's bytes, locally if we host it, otherwise from
+// its host over the same FetchChunk RPC used for replica fallback reads.
+func (s *ChunkServer) fetchShard(host, shardUUID string, addrByName map[string]string) ([]byte, error) {
+	if host == s.name {
+		return os.ReadFile(shardPath(shardUUID))
+	}
+	addr, ok := addrByName[host]
+	if !ok {
+		return nil, ErrFileNotExist
+	}
+	return s.fetchChunkFromPeer(addr, "shard/"+shardUUID)
+}
+
+// reconstructChunk re-assembles a chunk's original bytes from its shards,
+// tolerating up to config.RSParityShards missing or unreachable ones.
+func (s *ChunkServer) reconstructChunk(infos []*pb.ShardInfo, used int64) ([]byte, error) {
+	k, m := config.RSDataShards, config.RSParityShards
+
+	enc, err := reedsolomon.New(k, m)
+	if err != nil {
+		return nil, err
+	}
+
+	addrByName, err := s.peerAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	shardData := make([][]byte, k+m)
+	present := 0
+	for _, info := range infos {
+		data, err := s.fetchShard(info.Host, info.ShardUUID, addrByName)
+		if err != nil {
+			logger.WithFields(logrus.Fields{"shard_index": info.Index, "peer": info.Host}).WithError(err).Error("failed to fetch shard")
+			continue
+		}
+		shardData[info.Index] = data
+		present++
+	}
+
+	if present < k {
+		return nil, fmt.Errorf("only %d/%d shards available, need at least %d to reconstruct", present, k+m, k)
+	}
+
+	if err := enc.ReconstructData(shardData); err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	for i := 0; i < k; i++ {
+		out = append(out, shardData[i]...)
+	}
+	if int64(len(out)) > used {
+		out = out[:used]
+	}
+	return out, nil
+}
+
+// peerAddrs returns a name->addr map of every known chunkserver, ourselves
+// included, for shard placement and lookup.
+func (s *ChunkServer) peerAddrs() (map[string]string, error) {
+	peers, err := s.peers()
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]string{s.name: s.ip}
+	for _, p := range peers {
+		out[p.name] = p.addr
+	}
+	return out, nil
+}
+
+// updateChunkShardHost patches the Host of one shard within the owning
+// pb.File's embedded pb.Chunk.Shards - the copy reconstructChunk and
+// ReadFile actually read - so a repair is visible to future reads instead
+// of only updating the shard/ side-table repairShardsOf re-scans on its
+// next pass.
+func (s *ChunkServer) updateChunkShardHost(fileUUID, chunkUUID string, index int32, host string) error {
+	kvClient := clientv3.NewKV(s.etcdClient)
+	filePath := config.FileBasePath + fileUUID
+
+	resp, err := kvClient.Get(context.Background(), filePath)
+	if err != nil {
+		return err
+	}
+	if resp.Count != 1 {
+		return ErrFileNotExist
+	}
+
+	var file pb.File
+	if err := json.Unmarshal(resp.Kvs[0].Value, &file); err != nil {
+		return err
+	}
+
+	found := false
+	for _, c := range file.Chunks {
+		if c.UUID != chunkUUID {
+			continue
+		}
+		for _, info := range c.Shards {
+			if info.Index == index {
+				info.Host = host
+				found = true
+			}
+		}
+	}
+	if !found {
+		return ErrFileNotExist
+	}
+
+	v, err := utils.ToJSONString(file)
+	if err != nil {
+		return err
+	}
+	_, err = kvClient.Put(context.Background(), filePath, v)
+	return err
+}
+
+// repairShardsOf rebuilds every shard that deadWorker was hosting: it reads
+// the parent chunk's surviving shards, lets reedsolomon regenerate the
+// missing one, and places the rebuilt shard on a fresh host. It's the EC
+// analogue of reReplicateChunksOf, invoked from the same ChunkWatcher
+// worker-lease-expiry branch.
+func (s *ChunkServer) repairShardsOf(deadWorker string) {
+	kvClient := clientv3.NewKV(s.etcdClient)
+	resp, err := kvClient.Get(context.Background(), config.ChunkBasePath+"shard/", clientv3.WithPrefix())
+	if err != nil {
+		logger.WithFields(logrus.Fields{"worker": deadWorker}).WithError(err).Error("failed to list shards while repairing worker")
+		return
+	}
+
+	byParent := map[string][]shard{}
+	for _, kv := range resp.Kvs {
+		var sh shard
+		if err := json.Unmarshal(kv.Value, &sh); err != nil {
+			continue
+		}
+		byParent[sh.ParentChunk] = append(byParent[sh.ParentChunk], sh)
+	}
+
+	k, m := config.RSDataShards, config.RSParityShards
+	addrByName, err := s.peerAddrs()
+	if err != nil {
+		return
+	}
+
+	for parentChunk, shards := range byParent {
+		var lost *shard
+		for i := range shards {
+			if shards[i].Host == deadWorker {
+				lost = &shards[i]
+				break
+			}
+		}
+		if lost == nil {
+			continue
+		}
+
+		enc, err := reedsolomon.New(k, m)
+		if err != nil {
+			continue
+		}
+
+		shardData := make([][]byte, k+m)
+		for _, sh := range shards {
+			if sh.Host == deadWorker {
+				continue
+			}
+			data, err := s.fetchShard(sh.Host, sh.UUID, addrByName)
+			if err != nil {
+				continue
+			}
+			shardData[sh.Index] = data
+		}
+
+		if err := enc.Reconstruct(shardData); err != nil {
+			logger.WithFields(logrus.Fields{"chunk": parentChunk, "shard_index": lost.Index}).WithError(err).Error("failed to rebuild shard")
+			continue
+		}
+
+		target, err := s.pickRepairTarget(shards, deadWorker)
+		if err != nil {
+			logger.WithFields(logrus.Fields{"chunk": parentChunk, "shard_index": lost.Index}).WithError(err).Error("no spare host available to rebuild shard")
+			continue
+		}
+
+		if err := s.placeShard(target, lost.UUID, shardData[lost.Index]); err != nil {
+			logger.WithFields(logrus.Fields{"chunk": parentChunk, "shard_index": lost.Index, "peer": target.name}).WithError(err).Error("failed to place rebuilt shard")
+			continue
+		}
+
+		lost.Host = target.name
+		v, err := utils.ToJSONString(*lost)
+		if err != nil {
+			continue
+		}
+		if _, err := kvClient.Put(context.Background(), shardPath(lost.UUID), v); err != nil {
+			logger.WithFields(logrus.Fields{"shard": lost.UUID}).WithError(err).Error("failed to update metadata of shard")
+			continue
+		}
+
+		if err := s.updateChunkShardHost(lost.FileUUID, parentChunk, int32(lost.Index), target.name); err != nil {
+			logger.WithFields(logrus.Fields{"chunk": parentChunk, "shard_index": lost.Index, "file": lost.FileUUID}).WithError(err).Error("failed to update chunk metadata with rebuilt shard's host")
+			continue
+		}
+
+		logger.WithFields(logrus.Fields{"chunk": parentChunk, "shard_index": lost.Index, "peer": target.name}).Info("rebuilt shard")
+	}
+}
@@ -0,0 +1,259 @@
+package chunkserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/jiajunhuang/hfs/pb"
+	"github.com/jiajunhuang/hfs/pkg/config"
+	"github.com/jiajunhuang/hfs/pkg/utils"
+	"github.com/klauspost/reedsolomon"
+)
+
+// TestReconstructChunkTolerlatesLostParityShards encodes data the same way
+// encodeAndDistribute does, drops every parity shard, and checks
+// reconstructChunk still recovers the original bytes from the data shards
+// alone.
+func TestReconstructChunkTolerlatesLostParityShards(t *testing.T) {
+	s, cleanup := newTestChunkServer(t)
+	defer cleanup()
+
+	k, m := config.RSDataShards, config.RSParityShards
+	data := bytes.Repeat([]byte("erasure-coded-payload"), 100)
+	used := int64(len(data))
+
+	enc, err := reedsolomon.New(k, m)
+	if err != nil {
+		t.Fatalf("failed to build encoder: %v", err)
+	}
+	shardData, err := enc.Split(data)
+	if err != nil {
+		t.Fatalf("failed to split data: %v", err)
+	}
+	if err := enc.Encode(shardData); err != nil {
+		t.Fatalf("failed to encode parity: %v", err)
+	}
+
+	self := peer{name: s.name, addr: s.ip}
+	infos := make([]*pb.ShardInfo, k)
+	for i := 0; i < k; i++ {
+		shardUUID := fmt.Sprintf("data-shard-%d", i)
+		if err := s.placeShard(self, shardUUID, shardData[i]); err != nil {
+			t.Fatalf("failed to place shard %d: %v", i, err)
+		}
+		infos[i] = &pb.ShardInfo{ShardUUID: shardUUID, Index: int32(i), Host: s.name}
+	}
+
+	out, err := s.reconstructChunk(infos, used)
+	if err != nil {
+		t.Fatalf("reconstructChunk returned error with only data shards present: %v", err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("reconstructed bytes do not match original")
+	}
+}
+
+// TestPickRepairTargetExcludesDeadAndOccupiedHosts checks that a rebuilt
+// shard never lands back on the host that just died, and never collides
+// with a host that already holds another shard of the same chunk.
+func TestPickRepairTargetExcludesDeadAndOccupiedHosts(t *testing.T) {
+	s, cleanup := newTestChunkServer(t)
+	defer cleanup()
+
+	if _, err := s.etcdClient.Put(context.Background(), config.WorkerBasePath+"spare", "10.0.0.9:1234"); err != nil {
+		t.Fatalf("failed to seed spare worker: %v", err)
+	}
+
+	shards := []shard{
+		{UUID: "s0", ParentChunk: "c", Index: 0, Host: "dead"},
+		{UUID: "s1", ParentChunk: "c", Index: 1, Host: s.name},
+	}
+
+	target, err := s.pickRepairTarget(shards, "dead")
+	if err != nil {
+		t.Fatalf("expected a repair target, got error: %v", err)
+	}
+	if target.name == "dead" || target.name == s.name {
+		t.Fatalf("picked host %q already holds a shard or is the dead worker", target.name)
+	}
+	if target.name != "spare" {
+		t.Fatalf("target = %q, want the seeded spare worker", target.name)
+	}
+}
+
+// TestReleaseShardsRemovesFilesAndMetadata is the regression test for
+// RemoveFile leaking every EC-encoded chunk: releaseChunk only ever looks at
+// config.ChunkBasePath+c.UUID, a key an erasure-coded chunk never writes to,
+// so it used to silently no-op and leave every shard file and shard
+// metadata record behind forever.
+func TestReleaseShardsRemovesFilesAndMetadata(t *testing.T) {
+	s, cleanup := newTestChunkServer(t)
+	defer cleanup()
+
+	self := peer{name: s.name, addr: s.ip}
+	c := pb.Chunk{UUID: "parent-chunk", FileUUID: "file"}
+	for i := 0; i < 3; i++ {
+		shardUUID := fmt.Sprintf("release-shard-%d", i)
+		if err := s.placeShard(self, shardUUID, []byte("shard bytes")); err != nil {
+			t.Fatalf("failed to place shard %d: %v", i, err)
+		}
+		v, err := os.ReadFile(shardPath(shardUUID))
+		if err != nil || len(v) == 0 {
+			t.Fatalf("setup: shard %d was not written to disk", i)
+		}
+		if _, err := s.etcdClient.Put(context.Background(), shardPath(shardUUID), "{}"); err != nil {
+			t.Fatalf("setup: failed to write shard metadata: %v", err)
+		}
+		c.Shards = append(c.Shards, &pb.ShardInfo{ShardUUID: shardUUID, Index: int32(i), Host: s.name})
+	}
+
+	if err := s.releaseShards(&c); err != nil {
+		t.Fatalf("releaseShards returned error: %v", err)
+	}
+
+	for _, info := range c.Shards {
+		if _, err := os.Stat(shardPath(info.ShardUUID)); !os.IsNotExist(err) {
+			t.Fatalf("shard file %s was not removed (err=%v)", info.ShardUUID, err)
+		}
+		resp, err := s.etcdClient.Get(context.Background(), shardPath(info.ShardUUID))
+		if err != nil {
+			t.Fatalf("failed to check shard metadata: %v", err)
+		}
+		if resp.Count != 0 {
+			t.Fatalf("shard metadata for %s was not deleted", info.ShardUUID)
+		}
+	}
+}
+
+// TestRepairShardsOfUpdatesFileMetadataForReads is the end-to-end regression
+// test for repairShardsOf only updating the shard/ side-table: it rebuilds a
+// shard lost with a dead worker, checks the rebuild landed on a real second
+// chunkserver (not back on the dead host or the already-occupied local
+// host), and then reads the chunk back through the owning pb.File's own
+// Shards metadata - the thing ReadFile actually consults - to prove the
+// repair is visible there too, not just in the side-table.
+func TestRepairShardsOfUpdatesFileMetadataForReads(t *testing.T) {
+	primary, cleanup := newTestChunkServer(t)
+	defer cleanup()
+
+	peerServer := &ChunkServer{name: "peer", ip: "", etcdClient: primary.etcdClient}
+	peerAddr := startTestPeerChunkServer(t, peerServer)
+	if _, err := primary.etcdClient.Put(context.Background(), config.WorkerBasePath+"peer", peerAddr); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+
+	k, m := config.RSDataShards, config.RSParityShards
+	if m < 1 {
+		t.Fatalf("test requires at least one parity shard, config.RSParityShards = %d", m)
+	}
+	data := bytes.Repeat([]byte("erasure-coded-payload-for-repair-test"), 100)
+	used := int64(len(data))
+
+	enc, err := reedsolomon.New(k, m)
+	if err != nil {
+		t.Fatalf("failed to build encoder: %v", err)
+	}
+	shardData, err := enc.Split(data)
+	if err != nil {
+		t.Fatalf("failed to split data: %v", err)
+	}
+	if err := enc.Encode(shardData); err != nil {
+		t.Fatalf("failed to encode parity: %v", err)
+	}
+
+	const parentChunk = "repair-parent-chunk"
+	const fileUUID = "repair-file"
+	const lostIndex = 0
+
+	self := peer{name: primary.name, addr: primary.ip}
+	infos := make([]*pb.ShardInfo, k+m)
+	for i, d := range shardData {
+		shardUUID := fmt.Sprintf("repair-shard-%d", i)
+
+		host := primary.name
+		if i == lostIndex {
+			host = "dead" // simulate this shard's host having died
+		} else if err := primary.placeShard(self, shardUUID, d); err != nil {
+			// the dead host's bytes are not written: primary and peer share
+			// config.ChunkBasePath, so the peer's append of the rebuilt
+			// shard would otherwise land on top of them
+			t.Fatalf("failed to place shard %d: %v", i, err)
+		}
+
+		sh := shard{UUID: shardUUID, ParentChunk: parentChunk, FileUUID: fileUUID, Index: i, Host: host, Size: len(d)}
+		v, err := utils.ToJSONString(sh)
+		if err != nil {
+			t.Fatalf("failed to marshal shard metadata: %v", err)
+		}
+		if _, err := primary.etcdClient.Put(context.Background(), shardPath(shardUUID), v); err != nil {
+			t.Fatalf("failed to seed shard metadata: %v", err)
+		}
+
+		infos[i] = &pb.ShardInfo{ShardUUID: shardUUID, Index: int32(i), Host: host}
+	}
+
+	file := pb.File{
+		UUID: fileUUID,
+		Size: used,
+		Chunks: []*pb.Chunk{
+			{UUID: parentChunk, FileUUID: fileUUID, Used: used, Shards: infos},
+		},
+	}
+	fv, err := utils.ToJSONString(file)
+	if err != nil {
+		t.Fatalf("failed to marshal file metadata: %v", err)
+	}
+	if _, err := primary.etcdClient.Put(context.Background(), config.FileBasePath+fileUUID, fv); err != nil {
+		t.Fatalf("failed to seed file metadata: %v", err)
+	}
+
+	primary.repairShardsOf("dead")
+
+	resp, err := primary.etcdClient.Get(context.Background(), config.FileBasePath+fileUUID)
+	if err != nil {
+		t.Fatalf("failed to get file metadata after repair: %v", err)
+	}
+	if resp.Count != 1 {
+		t.Fatalf("expected file metadata to still exist, got count %d", resp.Count)
+	}
+
+	var repaired pb.File
+	if err := json.Unmarshal(resp.Kvs[0].Value, &repaired); err != nil {
+		t.Fatalf("failed to unmarshal repaired file metadata: %v", err)
+	}
+
+	var updatedInfos []*pb.ShardInfo
+	for _, c := range repaired.Chunks {
+		if c.UUID == parentChunk {
+			updatedInfos = c.Shards
+		}
+	}
+	if updatedInfos == nil {
+		t.Fatalf("repaired file metadata no longer has the parent chunk")
+	}
+
+	var lostHost string
+	for _, info := range updatedInfos {
+		if info.Index == lostIndex {
+			lostHost = info.Host
+		}
+	}
+	if lostHost == "dead" || lostHost == "" {
+		t.Fatalf("embedded pb.Chunk.Shards still points the repaired shard at %q, want it updated to the new host", lostHost)
+	}
+	if lostHost != "peer" {
+		t.Fatalf("repaired shard landed on %q, want it placed on the spare peer (self already hosts every other shard)", lostHost)
+	}
+
+	out, err := primary.reconstructChunk(updatedInfos, used)
+	if err != nil {
+		t.Fatalf("reconstructChunk using the repaired file metadata failed: %v", err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("reconstructed bytes read through the repaired metadata do not match original")
+	}
+}
@@ -0,0 +1,325 @@
+package chunkserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"os"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/google/uuid"
+	"github.com/jiajunhuang/hfs/pb"
+	"github.com/jiajunhuang/hfs/pkg/config"
+	"github.com/jiajunhuang/hfs/pkg/files"
+	"github.com/jiajunhuang/hfs/pkg/logger"
+	"github.com/jiajunhuang/hfs/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// uploadChunk is one config.ChunkSize-bounded chunk backing an in-progress
+// upload. Used is the number of real bytes written into it so far; only the
+// last uploadChunk of an upload may have Used < config.ChunkSize.
+type uploadChunk struct {
+	UUID string `json:"uuid"`
+	Used int64  `json:"used"`
+}
+
+// upload is the etcd-persisted state of a single resumable upload, keyed by
+// UploadBasePath+UUID and held alive by an etcd lease so that uploads that
+// are abandoned mid-transfer get garbage-collected instead of leaking chunk
+// files forever.
+type upload struct {
+	UUID     string `json:"uuid"`
+	FileName string `json:"file_name"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+	LeaseID  int64  `json:"lease_id"`
+
+	// DigestState is the hex-encoded, marshaled state of a sha256.Hash that's
+	// been fed every byte written so far, in order - a real incremental
+	// digest of the concatenated upload, not a hash of a hash. It's restored
+	// and advanced on every WriteUpload call so FinishUpload can finalize it
+	// and compare against a from-disk rehash of the assembled chunks.
+	DigestState string `json:"digest_state"`
+
+	Chunks  []uploadChunk `json:"chunks"`  // completed, full config.ChunkSize chunks
+	Current uploadChunk   `json:"current"` // in-progress chunk, Used < config.ChunkSize
+}
+
+// resumeDigest restores the incremental sha256 state persisted in
+// DigestState, or a fresh hash if this is the first write.
+func resumeDigest(state string) (hash.Hash, error) {
+	h := sha256.New()
+	if state == "" {
+		return h, nil
+	}
+	raw, err := hex.DecodeString(state)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(raw); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// marshalDigest serializes an in-progress sha256 hash's state for storage,
+// so the next WriteUpload call can resume hashing exactly where this one
+// left off instead of re-hashing from scratch or chaining digests.
+func marshalDigest(h hash.Hash) (string, error) {
+	raw, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// uploadLeaseTTL is how long an upload survives without a WriteUpload call
+// before it's reclaimed by etcd.
+const uploadLeaseTTL = 24 * 60 * 60 // seconds
+
+func (s *ChunkServer) uploadPath(uploadUUID string) string {
+	return config.UploadBasePath + uploadUUID
+}
+
+func (s *ChunkServer) getUpload(uploadUUID string) (*upload, error) {
+	kvClient := clientv3.NewKV(s.etcdClient)
+	resp, err := kvClient.Get(context.Background(), s.uploadPath(uploadUUID))
+	if err != nil {
+		logger.WithFields(logrus.Fields{"upload": uploadUUID}).WithError(err).Error("failed to get metadata of upload")
+		return nil, ErrFailedGetFile
+	}
+	if resp.Count != 1 {
+		return nil, ErrFileNotExist
+	}
+
+	var u upload
+	if err := json.Unmarshal(resp.Kvs[0].Value, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// putUpload persists u, re-attaching its lease so the key keeps expiring on
+// schedule - an etcd Put with no lease option detaches whatever lease the
+// key already had, so every caller past CreateUpload must pass u.LeaseID
+// back in, not 0.
+func (s *ChunkServer) putUpload(u *upload, leaseID clientv3.LeaseID) error {
+	v, err := utils.ToJSONString(*u)
+	if err != nil {
+		return err
+	}
+
+	kvClient := clientv3.NewKV(s.etcdClient)
+	opts := []clientv3.OpOption{}
+	if leaseID != 0 {
+		opts = append(opts, clientv3.WithLease(leaseID))
+	}
+	_, err = kvClient.Put(context.Background(), s.uploadPath(u.UUID), v, opts...)
+	return err
+}
+
+// CreateUpload starts a new resumable upload session and returns its
+// uploadID. No chunk is created up front: WriteUpload allocates chunks
+// lazily as data arrives, each bounded to config.ChunkSize bytes.
+func (s *ChunkServer) CreateUpload(ctx context.Context, req *pb.CreateUploadRequest) (*pb.CreateUploadResponse, error) {
+	u := upload{
+		UUID:     uuid.New().String(),
+		FileName: req.FileName,
+		Size:     req.Size,
+	}
+
+	lease := clientv3.NewLease(s.etcdClient)
+	grantResp, err := lease.Grant(context.Background(), uploadLeaseTTL)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"upload": u.UUID}).WithError(err).Error("failed to grant lease for upload")
+		return nil, ErrFailedWriteMeta
+	}
+	u.LeaseID = int64(grantResp.ID)
+
+	if err := s.putUpload(&u, grantResp.ID); err != nil {
+		logger.WithFields(logrus.Fields{"upload": u.UUID}).WithError(err).Error("failed to sync metadata of upload")
+		return nil, ErrFailedWriteMeta
+	}
+
+	logger.WithFields(logrus.Fields{"upload": u.UUID, "file_name": u.FileName}).Info("upload created")
+	return &pb.CreateUploadResponse{UploadUUID: u.UUID}, nil
+}
+
+// WriteUpload appends data at the given offset, splitting it across as many
+// config.ChunkSize-bounded chunks as it takes. It's idempotent: a chunk
+// that's already past the requested offset is treated as already written,
+// the same way tus treats a resumed PATCH.
+func (s *ChunkServer) WriteUpload(ctx context.Context, req *pb.WriteUploadRequest) (*pb.HeadUploadResponse, error) {
+	u, err := s.getUpload(req.UploadUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Offset < u.Offset {
+		logger.WithFields(logrus.Fields{"upload": u.UUID, "offset": req.Offset, "have": u.Offset}).Info("ignoring already-written offset")
+		return &pb.HeadUploadResponse{Offset: u.Offset}, nil
+	}
+	if req.Offset > u.Offset {
+		return nil, ErrFailedWrite
+	}
+
+	remaining := req.Data
+	for len(remaining) > 0 {
+		if u.Current.UUID == "" {
+			u.Current.UUID = uuid.New().String()
+		}
+
+		room := int64(config.ChunkSize) - u.Current.Used
+		n := int64(len(remaining))
+		if n > room {
+			n = room
+		}
+
+		chunkPath := config.ChunkBasePath + u.Current.UUID
+		if err := files.Append(chunkPath, bytes.NewReader(remaining[:n])); err != nil {
+			logger.WithFields(logrus.Fields{"upload": u.UUID, "chunk": u.Current.UUID}).WithError(err).Error("failed to write upload")
+			return nil, ErrFailedWrite
+		}
+
+		u.Current.Used += n
+		remaining = remaining[n:]
+
+		if u.Current.Used == int64(config.ChunkSize) {
+			u.Chunks = append(u.Chunks, u.Current)
+			u.Current = uploadChunk{}
+		}
+	}
+
+	h, err := resumeDigest(u.DigestState)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"upload": u.UUID}).WithError(err).Error("corrupt running checksum in upload metadata")
+		return nil, ErrFailedWriteMeta
+	}
+	h.Write(req.Data)
+	digestState, err := marshalDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	u.DigestState = digestState
+	u.Offset += int64(len(req.Data))
+
+	if err := s.putUpload(u, clientv3.LeaseID(u.LeaseID)); err != nil {
+		logger.WithFields(logrus.Fields{"upload": u.UUID}).WithError(err).Error("failed to sync metadata of upload")
+		return nil, ErrFailedWriteMeta
+	}
+	if _, err := s.etcdClient.KeepAliveOnce(context.Background(), clientv3.LeaseID(u.LeaseID)); err != nil {
+		logger.WithFields(logrus.Fields{"upload": u.UUID}).WithError(err).Error("failed to renew lease of upload")
+		return nil, ErrFailedWriteMeta
+	}
+
+	return &pb.HeadUploadResponse{Offset: u.Offset}, nil
+}
+
+// HeadUpload reports how many bytes have been durably written so a client
+// can resume from the right offset after a crash or disconnect.
+func (s *ChunkServer) HeadUpload(ctx context.Context, req *pb.HeadUploadRequest) (*pb.HeadUploadResponse, error) {
+	u, err := s.getUpload(req.UploadUUID)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.HeadUploadResponse{Offset: u.Offset}, nil
+}
+
+// FinishUpload turns a completed upload session into a regular pb.File,
+// replicating every chunk through replicate() (without CreateFile's
+// content-addressed dedup or erasure coding), verifying the
+// assembled bytes against the running checksum collected in WriteUpload,
+// then drops the upload's bookkeeping record.
+func (s *ChunkServer) FinishUpload(ctx context.Context, req *pb.FinishUploadRequest) (*pb.File, error) {
+	u, err := s.getUpload(req.UploadUUID)
+	if err != nil {
+		return nil, err
+	}
+	if u.Offset != u.Size {
+		logger.WithFields(logrus.Fields{"upload": u.UUID, "offset": u.Offset, "expected": u.Size}).Error("finish requested before upload is complete")
+		return nil, ErrFailedWrite
+	}
+
+	chunks := u.Chunks
+	if u.Current.Used > 0 {
+		chunks = append(chunks, u.Current)
+	}
+
+	kvClient := clientv3.NewKV(s.etcdClient)
+	digest := sha256.New()
+	fileChunks := make([]*pb.Chunk, 0, len(chunks))
+
+	for _, uc := range chunks {
+		chunkPath := config.ChunkBasePath + uc.UUID
+		data, err := os.ReadFile(chunkPath)
+		if err != nil {
+			logger.WithFields(logrus.Fields{"chunk": uc.UUID, "upload": u.UUID}).WithError(err).Error("failed to read back chunk for upload")
+			return nil, ErrFailedGetFile
+		}
+		digest.Write(data)
+
+		c := pb.Chunk{
+			UUID:     uc.UUID,
+			Size:     int64(config.ChunkSize),
+			Used:     uc.Used,
+			Replicas: []string{s.name},
+			FileUUID: u.UUID,
+		}
+		if err := s.replicate(&c, data); err != nil {
+			logger.WithFields(logrus.Fields{"chunk": c.UUID, "upload": u.UUID}).WithError(err).Error("failed to replicate chunk for upload")
+			return nil, ErrFailedWrite
+		}
+
+		v, err := utils.ToJSONString(c)
+		if err != nil {
+			return nil, ErrFailedWriteMeta
+		}
+		if _, err := kvClient.Put(context.Background(), chunkPath, v); err != nil {
+			logger.WithChunk(c.UUID, c.Used).WithError(err).Error("failed to sync metadata of chunk")
+			return nil, ErrFailedWriteMeta
+		}
+
+		fileChunks = append(fileChunks, &c)
+	}
+
+	h, err := resumeDigest(u.DigestState)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"upload": u.UUID}).WithError(err).Error("corrupt running checksum in upload metadata")
+		return nil, ErrFailedWriteMeta
+	}
+	if hex.EncodeToString(digest.Sum(nil)) != hex.EncodeToString(h.Sum(nil)) {
+		logger.WithFields(logrus.Fields{"upload": u.UUID}).Error("uploaded data failed checksum verification")
+		return nil, ErrChecksumMismatch
+	}
+
+	file := pb.File{
+		UUID:       u.UUID,
+		FileName:   u.FileName,
+		Size:       u.Size,
+		ReplicaNum: int32(config.ReplicaNum),
+		CreatedAt:  time.Now().Unix(),
+		UpdatedAt:  time.Now().Unix(),
+		Chunks:     fileChunks,
+	}
+	fv, err := utils.ToJSONString(file)
+	if err != nil {
+		return nil, ErrFailedWriteMeta
+	}
+	if _, err := kvClient.Put(context.Background(), config.FileBasePath+file.UUID, fv); err != nil {
+		logger.WithFile(file.UUID, file.FileName).WithError(err).Error("failed to sync metadata of file")
+		return nil, ErrFailedWriteMeta
+	}
+
+	if _, err := kvClient.Delete(context.Background(), s.uploadPath(u.UUID)); err != nil {
+		logger.WithFields(logrus.Fields{"upload": u.UUID}).WithError(err).Error("failed to delete metadata of upload")
+	}
+
+	logger.WithFields(logrus.Fields{"upload": u.UUID, "file": file.UUID}).Info("upload finished")
+	return &file, nil
+}
@@ -0,0 +1,93 @@
+package chunkserver
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/jiajunhuang/hfs/pb"
+)
+
+// TestFinishUploadSingleWriteRoundTrip covers the simple case: all the data
+// arrives in one WriteUpload call, so FinishUpload's checksum verification
+// passes even with a naive digest.
+func TestFinishUploadSingleWriteRoundTrip(t *testing.T) {
+	s, cleanup := newTestChunkServer(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	data := []byte("small upload that fits in a single WriteUpload call")
+
+	created, err := s.CreateUpload(ctx, &pb.CreateUploadRequest{FileName: "one-shot.txt", Size: int64(len(data))})
+	if err != nil {
+		t.Fatalf("CreateUpload failed: %v", err)
+	}
+
+	if _, err := s.WriteUpload(ctx, &pb.WriteUploadRequest{UploadUUID: created.UploadUUID, Offset: 0, Data: data}); err != nil {
+		t.Fatalf("WriteUpload failed: %v", err)
+	}
+
+	file, err := s.FinishUpload(ctx, &pb.FinishUploadRequest{UploadUUID: created.UploadUUID})
+	if err != nil {
+		t.Fatalf("FinishUpload failed: %v", err)
+	}
+	if file.Size != int64(len(data)) {
+		t.Fatalf("file size = %d, want %d", file.Size, len(data))
+	}
+	if len(file.Chunks) != 1 {
+		t.Fatalf("expected exactly one chunk, got %d", len(file.Chunks))
+	}
+}
+
+// TestFinishUploadMultipleWritesRoundTrip is the regression test for the
+// chained-digest bug: WriteUpload used to combine digests as
+// sha256(prev || new) instead of feeding a single streaming hash, so any
+// upload split across more than one call produced a DigestState that could
+// never match FinishUpload's from-disk rehash. A real resumable upload
+// always spans several calls, so this must succeed.
+func TestFinishUploadMultipleWritesRoundTrip(t *testing.T) {
+	s, cleanup := newTestChunkServer(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	data := []byte("this upload arrives across several separate WriteUpload calls, exactly the way a resumed client would resend it after a crash")
+
+	created, err := s.CreateUpload(ctx, &pb.CreateUploadRequest{FileName: "resumed.txt", Size: int64(len(data))})
+	if err != nil {
+		t.Fatalf("CreateUpload failed: %v", err)
+	}
+
+	const callSize = 7
+	var offset int64
+	for offset < int64(len(data)) {
+		end := offset + callSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		resp, err := s.WriteUpload(ctx, &pb.WriteUploadRequest{UploadUUID: created.UploadUUID, Offset: offset, Data: data[offset:end]})
+		if err != nil {
+			t.Fatalf("WriteUpload at offset %d failed: %v", offset, err)
+		}
+		offset = resp.Offset
+	}
+
+	file, err := s.FinishUpload(ctx, &pb.FinishUploadRequest{UploadUUID: created.UploadUUID})
+	if err != nil {
+		t.Fatalf("FinishUpload failed after a multi-call upload: %v", err)
+	}
+	if file.Size != int64(len(data)) {
+		t.Fatalf("file size = %d, want %d", file.Size, len(data))
+	}
+
+	var assembled []byte
+	for _, c := range file.Chunks {
+		got, err := s.readChunk(c)
+		if err != nil {
+			t.Fatalf("failed to read back chunk %s: %v", c.UUID, err)
+		}
+		assembled = append(assembled, got...)
+	}
+	if !bytes.Equal(assembled, data) {
+		t.Fatalf("assembled upload bytes do not match what was written")
+	}
+}
@@ -0,0 +1,39 @@
+// Package logger provides the module's structured logger: a logrus instance
+// wrapped with the runtime formatter so every line carries the caller's
+// file, line and function automatically, plus a handful of helpers for the
+// key/value fields chunkserver operations care about most.
+package logger
+
+import (
+	runtime "github.com/banzaicloud/logrus-runtime-formatter"
+	"github.com/jiajunhuang/hfs/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Log is the module-wide structured logger.
+var Log = logrus.New()
+
+func init() {
+	formatter := &runtime.Formatter{ChildFormatter: &logrus.TextFormatter{}, File: true, Line: true}
+	if config.LogFormatJSON {
+		formatter.ChildFormatter = &logrus.JSONFormatter{}
+	}
+	Log.Formatter = formatter
+}
+
+// WithFields starts a log entry carrying arbitrary key/value fields.
+func WithFields(fields logrus.Fields) *logrus.Entry {
+	return Log.WithFields(fields)
+}
+
+// WithChunk starts a log entry tagged with the fields common to chunk-level
+// operations.
+func WithChunk(chunkUUID string, size int64) *logrus.Entry {
+	return Log.WithFields(logrus.Fields{"chunk": chunkUUID, "size": size})
+}
+
+// WithFile starts a log entry tagged with the fields common to file-level
+// operations.
+func WithFile(fileUUID, fileName string) *logrus.Entry {
+	return Log.WithFields(logrus.Fields{"file": fileUUID, "name": fileName})
+}